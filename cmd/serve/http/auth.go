@@ -0,0 +1,346 @@
+package http
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ncw/rclone/fs"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Globals
+var (
+	htpasswdFile = ""
+	userName     = ""
+	password     = ""
+	realm        = ""
+	digestAuth   = false
+
+	// digestNonceMaxAge is how long a digest auth nonce stays valid for.
+	// A var rather than a const so tests can shrink it.
+	digestNonceMaxAge = 5 * time.Minute
+)
+
+func init() {
+	Command.Flags().StringVarP(&userName, "user", "", userName, "User name for authentication.")
+	Command.Flags().StringVarP(&password, "pass", "", password, "Password for authentication.")
+	Command.Flags().StringVarP(&htpasswdFile, "htpasswd", "", htpasswdFile, "htpasswd file - if not provided, --user/--pass is used.")
+	Command.Flags().StringVarP(&realm, "realm", "", realm, "realm for authentication (default \"rclone\")")
+	Command.Flags().BoolVarP(&digestAuth, "digest-auth", "", digestAuth, "Use HTTP Digest authentication instead of Basic.")
+}
+
+// defaultRealm is used when --realm isn't supplied
+const defaultRealm = "rclone"
+
+// authEntry is a single parsed htpasswd line
+type authEntry struct {
+	hash string // the password field, including any {SHA} or $2y$ prefix
+}
+
+// hashed reports whether the password field is one of the htpasswd hash
+// formats we understand, as opposed to a plain text password
+func (e authEntry) hashed() bool {
+	return strings.HasPrefix(e.hash, "{SHA}") || strings.HasPrefix(e.hash, "$2a$") ||
+		strings.HasPrefix(e.hash, "$2b$") || strings.HasPrefix(e.hash, "$2y$")
+}
+
+// check reports whether password matches this entry
+func (e authEntry) check(password string) bool {
+	switch {
+	case strings.HasPrefix(e.hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		return e.hash[len("{SHA}"):] == base64.StdEncoding.EncodeToString(sum[:])
+	case e.hashed(): // bcrypt
+		return bcrypt.CompareHashAndPassword([]byte(e.hash), []byte(password)) == nil
+	default: // plain text, as written by "htpasswd -p"
+		return subtle.ConstantTimeCompare([]byte(e.hash), []byte(password)) == 1
+	}
+}
+
+// parseHtpasswd reads an htpasswd file in "user:hash" format, one entry
+// per line, ignoring blank lines and comments
+func parseHtpasswd(path string) (map[string]authEntry, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+	users := map[string]authEntry{}
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			continue
+		}
+		users[line[:i]] = authEntry{hash: line[i+1:]}
+	}
+	return users, scanner.Err()
+}
+
+// authHandler wraps next with HTTP Basic or Digest authentication,
+// checked against either a single --user/--pass or an --htpasswd file
+type authHandler struct {
+	next   http.Handler
+	realm  string
+	digest bool
+
+	mu    sync.RWMutex
+	users map[string]authEntry // non-nil if --htpasswd is in use
+
+	nonces *nonceTracker // non-nil if --digest-auth is in use
+}
+
+// newAuthHandler wraps next in authHandler if any of --user, --pass or
+// --htpasswd were set, otherwise it returns next unchanged (--realm and
+// --digest-auth on their own don't enable authentication)
+func newAuthHandler(next http.Handler) http.Handler {
+	if userName == "" && password == "" && htpasswdFile == "" {
+		return next
+	}
+	r := realm
+	if r == "" {
+		r = defaultRealm
+	}
+	h := &authHandler{
+		next:  next,
+		realm: r,
+	}
+	if digestAuth {
+		h.digest = true
+		h.nonces = newNonceTracker()
+	}
+	if htpasswdFile != "" {
+		if err := h.reload(); err != nil {
+			fs.Errorf(nil, "Failed to load --htpasswd file: %v", err)
+		}
+		h.watchSIGHUP()
+	}
+	return h
+}
+
+// reload re-reads the htpasswd file, replacing the in-memory user table
+func (h *authHandler) reload() error {
+	users, err := parseHtpasswd(htpasswdFile)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	h.users = users
+	h.mu.Unlock()
+	fs.Logf(nil, "Loaded %d users from %q", len(users), htpasswdFile)
+	return nil
+}
+
+// watchSIGHUP reloads the htpasswd file whenever the process receives
+// SIGHUP, so credentials can be rotated without restarting the server
+func (h *authHandler) watchSIGHUP() {
+	sigHUP := make(chan os.Signal, 1)
+	signal.Notify(sigHUP, syscall.SIGHUP)
+	go func() {
+		for range sigHUP {
+			if err := h.reload(); err != nil {
+				fs.Errorf(nil, "Failed to reload --htpasswd file: %v", err)
+			}
+		}
+	}()
+}
+
+// entry looks up username, either in the htpasswd table or the single
+// --user/--pass pair
+func (h *authHandler) entry(username string) (authEntry, bool) {
+	h.mu.RLock()
+	users := h.users
+	h.mu.RUnlock()
+	if users != nil {
+		e, ok := users[username]
+		return e, ok
+	}
+	if username != userName {
+		return authEntry{}, false
+	}
+	return authEntry{hash: password}, true
+}
+
+// checkBasic validates a username/password pair
+func (h *authHandler) checkBasic(username, password string) bool {
+	e, ok := h.entry(username)
+	return ok && e.check(password)
+}
+
+// plainPassword returns the plain text password for username, if we
+// have one. Digest auth needs the plain password to compute HA1, so it
+// can't be used against bcrypt or {SHA} htpasswd entries - only plain
+// text ones or a single --user/--pass pair.
+func (h *authHandler) plainPassword(username string) (string, bool) {
+	e, ok := h.entry(username)
+	if !ok || e.hashed() {
+		return "", false
+	}
+	return e.hash, true
+}
+
+func (h *authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.digest {
+		h.serveDigest(w, r)
+		return
+	}
+	username, pass, ok := r.BasicAuth()
+	if ok && h.checkBasic(username, pass) {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", h.realm))
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+func (h *authHandler) serveDigest(w http.ResponseWriter, r *http.Request) {
+	fields := parseDigestHeader(r.Header.Get("Authorization"))
+	if fields != nil && h.checkDigest(r.Method, fields) {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	stale := fields != nil && h.nonces.stale(fields["nonce"])
+	w.Header().Set("WWW-Authenticate", h.digestChallenge(stale))
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// digestChallenge builds the WWW-Authenticate header for a new digest
+// auth round, issuing a fresh nonce
+func (h *authHandler) digestChallenge(stale bool) string {
+	challenge := fmt.Sprintf(`Digest realm=%q, qop="auth", nonce=%q, opaque=%q`,
+		h.realm, h.nonces.newNonce(), h.nonces.opaque)
+	if stale {
+		challenge += `, stale=true`
+	}
+	return challenge
+}
+
+// checkDigest validates the digest response in fields against the
+// user's plain text password, per RFC 7616 with qop=auth
+func (h *authHandler) checkDigest(method string, fields map[string]string) bool {
+	pass, ok := h.plainPassword(fields["username"])
+	if !ok {
+		return false
+	}
+	nc, err := strconv.ParseUint(fields["nc"], 16, 64)
+	if err != nil || !h.nonces.check(fields["nonce"], nc) {
+		return false
+	}
+	ha1 := md5hex(fields["username"] + ":" + h.realm + ":" + pass)
+	ha2 := md5hex(method + ":" + fields["uri"])
+	want := md5hex(strings.Join([]string{ha1, fields["nonce"], fields["nc"], fields["cnonce"], fields["qop"], ha2}, ":"))
+	return subtle.ConstantTimeCompare([]byte(want), []byte(fields["response"])) == 1
+}
+
+func md5hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseDigestHeader parses an `Authorization: Digest ...` header into
+// its key/value fields, returning nil if it is missing required fields
+func parseDigestHeader(header string) map[string]string {
+	const prefix = "Digest "
+	if !strings.HasPrefix(header, prefix) {
+		return nil
+	}
+	fields := map[string]string{}
+	for _, part := range strings.Split(header[len(prefix):], ",") {
+		part = strings.TrimSpace(part)
+		i := strings.IndexByte(part, '=')
+		if i < 0 {
+			continue
+		}
+		fields[part[:i]] = strings.Trim(part[i+1:], `"`)
+	}
+	for _, required := range []string{"username", "nonce", "nc", "cnonce", "response", "uri"} {
+		if fields[required] == "" {
+			return nil
+		}
+	}
+	return fields
+}
+
+// nonceTracker issues digest auth nonces and validates that they are
+// known, fresh, and not being replayed (nonce-count must strictly
+// increase between uses of the same nonce)
+type nonceTracker struct {
+	opaque string
+
+	mu     sync.Mutex
+	nonces map[string]*nonceState
+}
+
+type nonceState struct {
+	created time.Time
+	nc      uint64
+}
+
+func newNonceTracker() *nonceTracker {
+	return &nonceTracker{
+		opaque: randomHex(16),
+		nonces: map[string]*nonceState{},
+	}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newNonce mints and remembers a new nonce
+func (t *nonceTracker) newNonce() string {
+	nonce := randomHex(16)
+	t.mu.Lock()
+	t.nonces[nonce] = &nonceState{created: time.Now()}
+	t.mu.Unlock()
+	return nonce
+}
+
+// stale reports whether nonce is one we issued but has since expired
+func (t *nonceTracker) stale(nonce string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state, found := t.nonces[nonce]
+	return found && time.Since(state.created) > digestNonceMaxAge
+}
+
+// check validates that nonce is known, fresh and that nc is greater
+// than any nc seen before for this nonce, then records nc. It only
+// forgets the nonce on replay, so a genuinely expired nonce is still
+// found by stale() and reported back to the client.
+func (t *nonceTracker) check(nonce string, nc uint64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state, found := t.nonces[nonce]
+	if !found || time.Since(state.created) > digestNonceMaxAge {
+		return false
+	}
+	if nc <= state.nc {
+		delete(t.nonces, nonce)
+		return false
+	}
+	state.nc = nc
+	return true
+}
@@ -0,0 +1,204 @@
+package http
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ncw/rclone/fs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// resetAuthFlags clears the package level auth flags after a test that
+// sets them, so later tests in this package see the unauthenticated
+// defaults again
+func resetAuthFlags() {
+	userName = ""
+	password = ""
+	htpasswdFile = ""
+	realm = ""
+	digestAuth = false
+	digestNonceMaxAge = 5 * time.Minute
+}
+
+// startServerAt is like startServer but on its own bindAddress, so auth
+// tests don't collide with the unauthenticated server started by
+// TestInit
+func startServerAt(t *testing.T, f fs.Fs, bindAddress string) string {
+	s := newServer(f, bindAddress)
+	go s.serve()
+
+	pause := time.Millisecond
+	for i := 0; i < 10; i++ {
+		conn, err := net.Dial("tcp", bindAddress)
+		if err == nil {
+			_ = conn.Close()
+			return "http://" + bindAddress + "/"
+		}
+		time.Sleep(pause)
+		pause *= 2
+	}
+	t.Fatal("couldn't connect to server")
+	return ""
+}
+
+func TestBasicAuth(t *testing.T) {
+	defer resetAuthFlags()
+	userName = "basicuser"
+	password = "basicpass"
+
+	fs.LoadConfig()
+	f, err := fs.NewFs("testdata/files")
+	require.NoError(t, err)
+	url := startServerAt(t, f, "localhost:51778")
+
+	req, err := http.NewRequest("GET", url+"two.txt", nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("WWW-Authenticate"), `Basic realm="rclone"`)
+
+	req, err = http.NewRequest("GET", url+"two.txt", nil)
+	require.NoError(t, err)
+	req.SetBasicAuth("basicuser", "wrongpass")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	req, err = http.NewRequest("GET", url+"two.txt", nil)
+	require.NoError(t, err)
+	req.SetBasicAuth("basicuser", "basicpass")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestHtpasswdAuth(t *testing.T) {
+	defer resetAuthFlags()
+
+	dir, err := ioutil.TempDir("", "rclone-serve-http-htpasswd")
+	require.NoError(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	htFile := dir + "/htpasswd"
+	require.NoError(t, ioutil.WriteFile(htFile, []byte("plainuser:plainpass\n"), 0666))
+	htpasswdFile = htFile
+
+	fs.LoadConfig()
+	f, err := fs.NewFs("testdata/files")
+	require.NoError(t, err)
+	url := startServerAt(t, f, "localhost:51779")
+
+	req, err := http.NewRequest("GET", url+"two.txt", nil)
+	require.NoError(t, err)
+	req.SetBasicAuth("plainuser", "plainpass")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// rotate the htpasswd file and signal the process to reload it
+	require.NoError(t, ioutil.WriteFile(htFile, []byte("newuser:newpass\n"), 0666))
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	time.Sleep(100 * time.Millisecond) // let the SIGHUP handler run
+
+	req, err = http.NewRequest("GET", url+"two.txt", nil)
+	require.NoError(t, err)
+	req.SetBasicAuth("plainuser", "plainpass")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "old user should be gone after reload")
+
+	req, err = http.NewRequest("GET", url+"two.txt", nil)
+	require.NoError(t, err)
+	req.SetBasicAuth("newuser", "newpass")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "new user should work after reload")
+}
+
+// digestResponse computes the Authorization header value a compliant
+// digest auth client would send, mirroring checkDigest in auth.go
+func digestResponse(username, pass, method, uri, realm, nonce, nc, cnonce string) string {
+	h := func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	ha1 := h(username + ":" + realm + ":" + pass)
+	ha2 := h(method + ":" + uri)
+	response := h(strings.Join([]string{ha1, nonce, nc, cnonce, "auth", ha2}, ":"))
+	return fmt.Sprintf(`Digest username=%q, realm=%q, nonce=%q, uri=%q, qop=auth, nc=%s, cnonce=%q, response=%q`,
+		username, realm, nonce, uri, nc, cnonce, response)
+}
+
+// digestChallengeField extracts a single field from a Digest
+// WWW-Authenticate header
+func digestChallengeField(t *testing.T, header, field string) string {
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if strings.HasPrefix(part, field+"=") {
+			return strings.Trim(part[len(field)+1:], `"`)
+		}
+	}
+	t.Fatalf("field %q not found in %q", field, header)
+	return ""
+}
+
+func TestDigestAuth(t *testing.T) {
+	defer resetAuthFlags()
+	userName = "digestuser"
+	password = "digestpass"
+	digestAuth = true
+
+	fs.LoadConfig()
+	f, err := fs.NewFs("testdata/files")
+	require.NoError(t, err)
+	url := startServerAt(t, f, "localhost:51780")
+
+	// first request has no Authorization header, so we expect a challenge
+	req, err := http.NewRequest("GET", url+"two.txt", nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	challenge := resp.Header.Get("WWW-Authenticate")
+	require.Contains(t, challenge, "Digest")
+	nonce := digestChallengeField(t, challenge, "nonce")
+	require.NotEmpty(t, nonce)
+
+	// answer the challenge correctly
+	req, err = http.NewRequest("GET", url+"two.txt", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", digestResponse("digestuser", "digestpass", "GET", "/two.txt", "rclone", nonce, "00000001", "abcd1234"))
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// a nonce that has already expired is reported as stale, not just
+	// rejected outright
+	digestNonceMaxAge = time.Millisecond
+	req, err = http.NewRequest("GET", url+"two.txt", nil)
+	require.NoError(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	staleNonce := digestChallengeField(t, resp.Header.Get("WWW-Authenticate"), "nonce")
+	time.Sleep(10 * time.Millisecond)
+
+	req, err = http.NewRequest("GET", url+"two.txt", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", digestResponse("digestuser", "digestpass", "GET", "/two.txt", "rclone", staleNonce, "00000001", "abcd1234"))
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("WWW-Authenticate"), "stale=true")
+}
@@ -0,0 +1,500 @@
+// Package http implements a basic web server interface to rclone
+package http
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ncw/rclone/fs"
+	"github.com/spf13/cobra"
+)
+
+// Globals
+var (
+	bindAddress = "localhost:8080"
+)
+
+func init() {
+	Command.Flags().StringVarP(&bindAddress, "addr", "", bindAddress, "IPaddress:Port to bind server to.")
+}
+
+// Command definition for cobra
+var Command = &cobra.Command{
+	Use:   "http remote:path",
+	Short: `Serve the remote over HTTP.`,
+	Long: `
+rclone serve http implements a basic web server to serve the remote
+over HTTP.  This can be viewed in a web browser or you can make a
+remote of type http read from it.
+
+Use --addr to specify which IP address and port the server should
+listen on, eg --addr localhost:8080 or --addr :8080 to listen to all
+IPs.
+`,
+	Run: func(command *cobra.Command, args []string) {
+		fs.CheckArgs(1, 1, command, args)
+		f := fs.NewFsSrc(args)
+		s := newServer(f, bindAddress)
+		s.serve()
+	},
+}
+
+// server contains everything to run the server
+type server struct {
+	f           fs.Fs
+	bindAddress string
+	accessLog   *accessLog
+}
+
+// newServer creates a new server for f which will listen at bindAddress
+func newServer(f fs.Fs, bindAddress string) *server {
+	s := &server{
+		f:           f,
+		bindAddress: bindAddress,
+	}
+	return s
+}
+
+// serve runs the http server, only returning (after logging the
+// error) if the listener can't be started or stops serving
+func (s *server) serve() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handler)
+
+	accessLog, err := newAccessLog(logFilePath)
+	if err != nil {
+		fs.Errorf(s.f, "Failed to open --log-file: %v", err)
+	}
+	s.accessLog = accessLog
+
+	var handler http.Handler = newAuthHandler(mux)
+	handler = s.loggingMiddleware(handler)
+
+	if metricsAddr != "" {
+		go s.serveMetrics()
+	}
+
+	l, err := listen(s.bindAddress)
+	if err != nil {
+		fs.Errorf(s.f, "Failed to start listener: %v", err)
+		return
+	}
+
+	scheme := "http"
+	if certFile != "" {
+		scheme = "https"
+	}
+	fs.Logf(s.f, "Serving on %s://%s/", scheme, s.bindAddress)
+	err = http.Serve(l, handler)
+	if err != nil {
+		fs.Errorf(s.f, "Failed to serve: %v", err)
+	}
+}
+
+// error logs the error and sends an http.Error with it
+func (s *server) error(w http.ResponseWriter, text string, err error, status int) {
+	fs.Errorf(s.f, "%s: %v", text, err)
+	http.Error(w, text, status)
+}
+
+// dirEntry is a directory entry ready for render in the directory template
+type dirEntry struct {
+	remote string
+	URL    string
+	Leaf   string
+}
+
+// dirEntries is a slice of dirEntry ready for render in the directory template
+type dirEntries []dirEntry
+
+// indexTemplate is the template used to render a directory listing
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{ .Title }}</title></head>
+<body>
+<h1>{{ .Title }}</h1>
+<ul>
+{{ if .Parent }}<li><a href="{{ .Parent }}">../</a></li>
+{{ end }}{{ range .Entries }}<li><a href="{{ .URL }}">{{ .Leaf }}</a></li>
+{{ end }}</ul>
+</body>
+</html>
+`))
+
+// indexData is the data passed to indexTemplate
+type indexData struct {
+	Title   string
+	Parent  string
+	Entries dirEntries
+}
+
+// list the directory at dir, filtering with the configured filters and
+// returning the entries sorted by remote name
+func (s *server) list(dir string) (entries dirEntries, err error) {
+	start := time.Now()
+	dirEntries, err := s.f.List(dir)
+	httpMetrics.addOperation("List", time.Since(start))
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range dirEntries {
+		switch x := entry.(type) {
+		case fs.Object:
+			if !fs.Config.Filter.IncludeObject(x) {
+				continue
+			}
+		case fs.Dir:
+			if !fs.Config.Filter.IncludeDirectory(x.Remote()) {
+				continue
+			}
+		default:
+			continue
+		}
+		remote := entry.Remote()
+		leaf := path.Base(remote)
+		href := leaf
+		if _, isDir := entry.(fs.Dir); isDir {
+			leaf += "/"
+			href += "/"
+		}
+		entries = append(entries, dirEntry{
+			remote: remote,
+			URL:    (&url.URL{Path: href}).String(),
+			Leaf:   leaf,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].remote < entries[j].remote
+	})
+	return entries, nil
+}
+
+// handler dispatches requests to either the directory listing or the
+// file server depending on whether the path looks like a directory,
+// or to the write handlers when --read-write is set
+func (s *server) handler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+		w.Header().Set("Accept-Ranges", "bytes")
+		remote := strings.Trim(r.URL.Path, "/")
+		if strings.HasSuffix(r.URL.Path, "/") {
+			s.serveDir(w, r, remote)
+			return
+		}
+		s.serveFile(w, r, remote)
+	case "PUT", "DELETE", "MKCOL", "MOVE":
+		if !readWrite {
+			s.error(w, "Method not allowed", fmt.Errorf("method %q not allowed", r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+		s.handleWrite(w, r)
+	default:
+		s.error(w, "Method not allowed", fmt.Errorf("method %q not allowed", r.Method), http.StatusMethodNotAllowed)
+	}
+}
+
+// serveDir renders the directory listing for remote
+func (s *server) serveDir(w http.ResponseWriter, r *http.Request, remote string) {
+	if remote != "" && !fs.Config.Filter.IncludeDirectory(remote) {
+		s.error(w, "Directory not found", fmt.Errorf("excluded by filters"), http.StatusNotFound)
+		return
+	}
+	entries, err := s.list(remote)
+	if err != nil {
+		s.error(w, "Failed to list directory", err, http.StatusNotFound)
+		return
+	}
+	var parent string
+	if remote != "" {
+		parent = "../"
+	}
+	data := indexData{
+		Title:   "/" + remote,
+		Parent:  parent,
+		Entries: entries,
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == "HEAD" {
+		return
+	}
+	err = indexTemplate.Execute(w, data)
+	if err != nil {
+		fs.Errorf(s.f, "Failed to render directory listing: %v", err)
+	}
+}
+
+// httpRange represents a single byte range of a request, with End being
+// inclusive as in the Range header
+type httpRange struct {
+	Start, End int64
+}
+
+// length returns the number of bytes covered by the range
+func (r httpRange) length() int64 {
+	return r.End - r.Start + 1
+}
+
+// contentRange renders the Content-Range header value for this range
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.Start, r.End, size)
+}
+
+// parseRange parses a Range header as defined in RFC 7233 against an
+// object of the given size. It normalises suffix ranges (-N), clamps
+// ranges that extend past the end of the object, drops ranges that are
+// not satisfiable and coalesces overlapping/adjacent ranges so a
+// malicious request can't force the same bytes to be served many times
+// over.
+func parseRange(s string, size int64) (ranges []httpRange, err error) {
+	const b = "bytes="
+	if !strings.HasPrefix(s, b) {
+		return nil, fmt.Errorf("invalid range %q", s)
+	}
+	for _, ra := range strings.Split(s[len(b):], ",") {
+		ra = strings.TrimSpace(ra)
+		if ra == "" {
+			continue
+		}
+		i := strings.IndexByte(ra, '-')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid range %q", ra)
+		}
+		startStr, endStr := strings.TrimSpace(ra[:i]), strings.TrimSpace(ra[i+1:])
+		var r httpRange
+		if startStr == "" {
+			// suffix range "-N": last N bytes
+			n, err := strconv.ParseInt(endStr, 10, 64)
+			if err != nil || n <= 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			r = httpRange{Start: size - n, End: size - 1}
+		} else {
+			start, err := strconv.ParseInt(startStr, 10, 64)
+			if err != nil || start < 0 || start >= size {
+				continue
+			}
+			end := size - 1
+			if endStr != "" {
+				end, err = strconv.ParseInt(endStr, 10, 64)
+				if err != nil || end < start {
+					continue
+				}
+				if end >= size {
+					end = size - 1
+				}
+			}
+			r = httpRange{Start: start, End: end}
+		}
+		ranges = append(ranges, r)
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("no satisfiable ranges in %q", s)
+	}
+	ranges = coalesceRanges(ranges)
+	if len(ranges) > maxRanges {
+		return nil, fmt.Errorf("too many ranges in %q: %d coalesced ranges exceeds the limit of %d", s, len(ranges), maxRanges)
+	}
+	return ranges, nil
+}
+
+// maxRanges caps the number of satisfiable ranges a single request may
+// ask for, after coalescing. Without this, "bytes=0-0,2-2,4-4,..." can
+// force one backend Object.Open round-trip per tiny range with no
+// upper bound, amplifying a single request into many against a remote Fs.
+const maxRanges = 100
+
+// coalesceRanges sorts and merges overlapping or adjacent ranges so
+// that requesting e.g. "0-1000000,0-1000000,..." repeatedly can't be
+// used to make the server do far more work than the single range
+// warrants.
+func coalesceRanges(ranges []httpRange) []httpRange {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if r.Start <= last.End+1 {
+			if r.End > last.End {
+				last.End = r.End
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// serveFile serves a single file, honouring Range requests, including
+// multiple ranges which are returned as a multipart/byteranges response
+// as described in RFC 7233.
+func (s *server) serveFile(w http.ResponseWriter, r *http.Request, remote string) {
+	o, err := s.f.NewObject(remote)
+	if err != nil {
+		s.error(w, "File not found", err, http.StatusNotFound)
+		return
+	}
+	if !fs.Config.Filter.IncludeObject(o) {
+		s.error(w, "File not found", fmt.Errorf("excluded by filters"), http.StatusNotFound)
+		return
+	}
+	size := o.Size()
+
+	rangeHeader := r.Header.Get("Range")
+	if rangeHeader == "" {
+		s.serveWhole(w, r, o)
+		return
+	}
+
+	ranges, err := parseRange(rangeHeader, size)
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		s.error(w, "Requested range not satisfiable", err, http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	if len(ranges) == 1 {
+		s.serveRange(w, r, o, ranges[0], size, mimeType(remote))
+		return
+	}
+
+	contentType, err := sniffContentType(o)
+	if err != nil {
+		s.error(w, "Failed to open file", err, http.StatusNotFound)
+		return
+	}
+	s.serveMultipartRanges(w, r, o, ranges, size, contentType)
+}
+
+// sniffContentType sniffs the content type of o from the first 512
+// bytes of its content, as recommended by RFC 7233 for the Content-Type
+// of each part of a multipart/byteranges response.
+func sniffContentType(o fs.Object) (string, error) {
+	start := time.Now()
+	in, err := o.Open(&fs.RangeOption{Start: 0, End: 511})
+	httpMetrics.addOperation("Open", time.Since(start))
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(in, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// serveWhole serves an object with no Range request
+func (s *server) serveWhole(w http.ResponseWriter, r *http.Request, o fs.Object) {
+	w.Header().Set("Content-Type", mimeType(o.Remote()))
+	w.Header().Set("Content-Length", strconv.FormatInt(o.Size(), 10))
+	if r.Method == "HEAD" {
+		return
+	}
+	start := time.Now()
+	in, err := o.Open()
+	httpMetrics.addOperation("Open", time.Since(start))
+	if err != nil {
+		s.error(w, "Failed to open file", err, http.StatusNotFound)
+		return
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+	_, err = io.Copy(w, in)
+	if err != nil {
+		fs.Errorf(s.f, "Failed to send file: %v", err)
+	}
+}
+
+// serveRange serves a single byte range of o
+func (s *server) serveRange(w http.ResponseWriter, r *http.Request, o fs.Object, rng httpRange, size int64, contentType string) {
+	w.Header().Set("Content-Range", rng.contentRange(size))
+	w.Header().Set("Content-Length", strconv.FormatInt(rng.length(), 10))
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusPartialContent)
+	if r.Method == "HEAD" {
+		return
+	}
+	start := time.Now()
+	in, err := o.Open(&fs.RangeOption{Start: rng.Start, End: rng.End})
+	httpMetrics.addOperation("Open", time.Since(start))
+	if err != nil {
+		fs.Errorf(s.f, "Failed to open file for range: %v", err)
+		return
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+	_, err = io.CopyN(w, in, rng.length())
+	if err != nil && err != io.EOF {
+		fs.Errorf(s.f, "Failed to send range: %v", err)
+	}
+}
+
+// serveMultipartRanges serves several byte ranges of o as a
+// multipart/byteranges response
+func (s *server) serveMultipartRanges(w http.ResponseWriter, r *http.Request, o fs.Object, ranges []httpRange, size int64, contentType string) {
+	w.Header().Set("Content-Type", "multipart/byteranges; boundary=RCLONE-BYTERANGES")
+	w.WriteHeader(http.StatusPartialContent)
+	if r.Method == "HEAD" {
+		return
+	}
+	mw := multipart.NewWriter(w)
+	err := mw.SetBoundary("RCLONE-BYTERANGES")
+	if err != nil {
+		fs.Errorf(s.f, "Failed to set multipart boundary: %v", err)
+		return
+	}
+	for _, rng := range ranges {
+		part, err := mw.CreatePart(map[string][]string{
+			"Content-Type":  {contentType},
+			"Content-Range": {rng.contentRange(size)},
+		})
+		if err != nil {
+			fs.Errorf(s.f, "Failed to create multipart range: %v", err)
+			return
+		}
+		start := time.Now()
+		in, err := o.Open(&fs.RangeOption{Start: rng.Start, End: rng.End})
+		httpMetrics.addOperation("Open", time.Since(start))
+		if err != nil {
+			fs.Errorf(s.f, "Failed to open file for range: %v", err)
+			return
+		}
+		_, err = io.CopyN(part, in, rng.length())
+		_ = in.Close()
+		if err != nil && err != io.EOF {
+			fs.Errorf(s.f, "Failed to send range: %v", err)
+			return
+		}
+	}
+	err = mw.Close()
+	if err != nil {
+		fs.Errorf(s.f, "Failed to close multipart writer: %v", err)
+	}
+}
+
+// mimeType sniffs the content type of remote from its extension,
+// falling back to application/octet-stream
+func mimeType(remote string) string {
+	ct := mime.TypeByExtension(path.Ext(remote))
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+	return ct
+}
@@ -2,6 +2,7 @@ package http
 
 import (
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -171,6 +172,24 @@ func TestGET(t *testing.T) {
 			Range:  "bytes=3-",
 			Golden: "testdata/golden/two3-.txt",
 		},
+		{
+			URL:    "two.txt",
+			Status: http.StatusPartialContent,
+			Range:  "bytes=5-1000",
+			Golden: "testdata/golden/two5-1000.txt",
+		},
+		{
+			URL:    "two.txt",
+			Status: http.StatusPartialContent,
+			Range:  "bytes=0-0,-2",
+			Golden: "testdata/golden/two-multi1.txt",
+		},
+		{
+			URL:    "two.txt",
+			Status: http.StatusPartialContent,
+			Range:  "bytes=0-1,5-8",
+			Golden: "testdata/golden/two-multi2.txt",
+		},
 	} {
 		method := test.Method
 		if method == "" {
@@ -190,3 +209,16 @@ func TestGET(t *testing.T) {
 		checkGolden(t, test.Golden, body)
 	}
 }
+
+// TestParseRangeTooManyRanges checks that a request asking for more
+// than maxRanges non-adjacent ranges is rejected, so it can't be used
+// to amplify one request into many backend Object.Open calls.
+func TestParseRangeTooManyRanges(t *testing.T) {
+	parts := make([]string, maxRanges+1)
+	for i := range parts {
+		parts[i] = fmt.Sprintf("%d-%d", i*2, i*2)
+	}
+
+	_, err := parseRange("bytes="+strings.Join(parts, ","), int64(2*len(parts)))
+	require.Error(t, err)
+}
@@ -0,0 +1,333 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/ncw/rclone/fs"
+)
+
+// Globals
+var (
+	logFilePath = ""
+	logFormat   = "combined"
+	metricsAddr = ""
+)
+
+func init() {
+	Command.Flags().StringVarP(&logFilePath, "log-file", "", logFilePath, "Path to write access log lines to (access logging is off if unset).")
+	Command.Flags().StringVarP(&logFormat, "log-format", "", logFormat, "Access log format, \"combined\" (CLF) or \"json\".")
+	Command.Flags().StringVarP(&metricsAddr, "metrics-addr", "", metricsAddr, "IPaddress:Port for a separate Prometheus /metrics listener.")
+}
+
+// accessRecord is one line of the access log, in either combined log
+// format or JSON depending on --log-format
+type accessRecord struct {
+	RemoteAddr string    `json:"remote_addr"`
+	Time       time.Time `json:"time"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	Referer    string    `json:"referer"`
+	UserAgent  string    `json:"user_agent"`
+	Duration   float64   `json:"duration_seconds"`
+}
+
+// accessLog writes accessRecords to --log-file, reopening it on
+// SIGHUP so it plays nicely with logrotate
+type accessLog struct {
+	path string
+
+	mu  sync.Mutex
+	out *os.File
+}
+
+// newAccessLog opens path for appending, or returns a nil *accessLog if
+// path is empty, meaning access logging is disabled
+func newAccessLog(path string) (*accessLog, error) {
+	if path == "" {
+		return nil, nil
+	}
+	l := &accessLog{path: path}
+	if err := l.reopen(); err != nil {
+		return nil, err
+	}
+	l.watchSIGHUP()
+	return l, nil
+}
+
+func (l *accessLog) reopen() error {
+	out, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	old := l.out
+	l.out = out
+	l.mu.Unlock()
+	if old != nil {
+		_ = old.Close()
+	}
+	return nil
+}
+
+func (l *accessLog) watchSIGHUP() {
+	sigHUP := make(chan os.Signal, 1)
+	signal.Notify(sigHUP, syscall.SIGHUP)
+	go func() {
+		for range sigHUP {
+			if err := l.reopen(); err != nil {
+				fs.Errorf(nil, "Failed to reopen --log-file %q: %v", l.path, err)
+			}
+		}
+	}()
+}
+
+// write formats and appends rec, a no-op if l is nil (logging disabled)
+func (l *accessLog) write(rec accessRecord) {
+	if l == nil {
+		return
+	}
+	var line string
+	if logFormat == "json" {
+		b, err := json.Marshal(rec)
+		if err != nil {
+			fs.Errorf(nil, "Failed to marshal access log record: %v", err)
+			return
+		}
+		line = string(b) + "\n"
+	} else {
+		// Apache combined log format
+		line = fmt.Sprintf("%s - - [%s] %q %d %d %q %q\n",
+			rec.RemoteAddr,
+			rec.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			fmt.Sprintf("%s %s HTTP/1.1", rec.Method, rec.Path),
+			rec.Status, rec.Bytes, rec.Referer, rec.UserAgent)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.out != nil {
+		_, _ = l.out.WriteString(line)
+	}
+}
+
+// statusRecorder wraps a http.ResponseWriter to capture the status
+// code and number of bytes written, for access logging and metrics
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// loggingMiddleware records the access log line and updates httpMetrics
+// for every request that passes through it
+func (s *server) loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&httpMetrics.inFlight, 1)
+		defer atomic.AddInt64(&httpMetrics.inFlight, -1)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+		duration := time.Since(start)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		httpMetrics.addRequest(rec.status, rec.bytes, duration)
+		s.accessLog.write(accessRecord{
+			RemoteAddr: r.RemoteAddr,
+			Time:       start,
+			Method:     r.Method,
+			Path:       r.URL.RequestURI(),
+			Status:     rec.status,
+			Bytes:      rec.bytes,
+			Referer:    r.Referer(),
+			UserAgent:  r.UserAgent(),
+			Duration:   duration.Seconds(),
+		})
+	})
+}
+
+// latencyBuckets are the histogram bucket upper bounds (seconds) used
+// for both the request-duration and operation-duration histograms
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// byteBuckets are the histogram bucket upper bounds (bytes) used for
+// the response-size histogram
+var byteBuckets = []float64{100, 1000, 10000, 100000, 1000000, 10000000, 100000000}
+
+// histogram is a hand-rolled Prometheus histogram, keyed by an
+// arbitrary label value (eg a status class or operation name)
+type histogram struct {
+	buckets []float64
+
+	mu   sync.Mutex
+	data map[string]*histogramData
+}
+
+// histogramData is the running total for one label value of a histogram
+type histogramData struct {
+	counts []uint64 // counts[i] is the number of observations in (buckets[i-1], buckets[i]]
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, data: map[string]*histogramData{}}
+}
+
+// observe records v under label, creating the label's bucket set if needed
+func (h *histogram) observe(label string, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	d, ok := h.data[label]
+	if !ok {
+		d = &histogramData{counts: make([]uint64, len(h.buckets))}
+		h.data[label] = d
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			d.counts[i]++
+			break
+		}
+	}
+	d.sum += v
+	d.count++
+}
+
+// writeTo renders name as a Prometheus histogram, with labelName=label
+// for each label value observed
+func (h *histogram) writeTo(w io.Writer, name, help, labelName string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for label, d := range h.data {
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += d.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s=%q,le=%q} %d\n", name, labelName, label, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"+Inf\"} %d\n", name, labelName, label, d.count)
+		fmt.Fprintf(w, "%s_sum{%s=%q} %g\n", name, labelName, label, d.sum)
+		fmt.Fprintf(w, "%s_count{%s=%q} %d\n", name, labelName, label, d.count)
+	}
+}
+
+// requestMetrics accumulates the counters and histograms exposed on
+// /metrics in Prometheus text exposition format
+type requestMetrics struct {
+	inFlight int64 // atomic
+
+	mu          sync.Mutex
+	byStatus    map[string]*uint64
+	byOperation map[string]*uint64
+
+	responseSize    *histogram // by status class
+	requestDuration *histogram // by status class
+	operationDur    *histogram // by operation
+}
+
+// httpMetrics is the process-wide set of metrics for this serve http
+// instance
+var httpMetrics = &requestMetrics{
+	byStatus:        map[string]*uint64{},
+	byOperation:     map[string]*uint64{},
+	responseSize:    newHistogram(byteBuckets),
+	requestDuration: newHistogram(latencyBuckets),
+	operationDur:    newHistogram(latencyBuckets),
+}
+
+func (m *requestMetrics) addRequest(status int, bytes int64, duration time.Duration) {
+	class := fmt.Sprintf("%dxx", status/100)
+	atomic.AddUint64(m.counter(&m.byStatus, class), 1)
+	m.responseSize.observe(class, float64(bytes))
+	m.requestDuration.observe(class, duration.Seconds())
+}
+
+// addOperation records one call to a given rclone Fs/Object operation
+// (eg "Open", "List", "Put") made while serving an HTTP request, along
+// with how long the call took
+func (m *requestMetrics) addOperation(op string, duration time.Duration) {
+	atomic.AddUint64(m.counter(&m.byOperation, op), 1)
+	m.operationDur.observe(op, duration.Seconds())
+}
+
+// counter returns the *uint64 for key in *table, creating it if needed
+func (m *requestMetrics) counter(table *map[string]*uint64, key string) *uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := (*table)[key]
+	if !ok {
+		p = new(uint64)
+		(*table)[key] = p
+	}
+	return p
+}
+
+// writeTo renders all the metrics in Prometheus text exposition format
+func (m *requestMetrics) writeTo(w io.Writer) {
+	fmt.Fprintln(w, "# HELP rclone_http_requests_in_flight Number of HTTP requests currently being served")
+	fmt.Fprintln(w, "# TYPE rclone_http_requests_in_flight gauge")
+	fmt.Fprintf(w, "rclone_http_requests_in_flight %d\n", atomic.LoadInt64(&m.inFlight))
+
+	fmt.Fprintln(w, "# HELP rclone_http_requests_total Total number of HTTP requests, by response status class")
+	fmt.Fprintln(w, "# TYPE rclone_http_requests_total counter")
+	m.mu.Lock()
+	for class, p := range m.byStatus {
+		fmt.Fprintf(w, "rclone_http_requests_total{status_class=%q} %d\n", class, atomic.LoadUint64(p))
+	}
+	m.mu.Unlock()
+
+	m.responseSize.writeTo(w, "rclone_http_response_size_bytes", "Size of HTTP response bodies, by response status class", "status_class")
+	m.requestDuration.writeTo(w, "rclone_http_request_duration_seconds", "Latency of HTTP requests, by response status class", "status_class")
+
+	fmt.Fprintln(w, "# HELP rclone_fs_operations_total Total number of rclone Fs/Object operations performed to serve HTTP requests")
+	fmt.Fprintln(w, "# TYPE rclone_fs_operations_total counter")
+	m.mu.Lock()
+	for op, p := range m.byOperation {
+		fmt.Fprintf(w, "rclone_fs_operations_total{operation=%q} %d\n", op, atomic.LoadUint64(p))
+	}
+	m.mu.Unlock()
+
+	m.operationDur.writeTo(w, "rclone_fs_operation_duration_seconds", "Latency of rclone Fs/Object operations performed to serve HTTP requests, by operation", "operation")
+}
+
+// serveMetrics listens on --metrics-addr, serving only /metrics - kept
+// off the main mux so files named "metrics" are never shadowed
+func (s *server) serveMetrics() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		httpMetrics.writeTo(w)
+	})
+	fs.Logf(s.f, "Serving metrics on http://%s/metrics", metricsAddr)
+	if err := http.ListenAndServe(metricsAddr, mux); err != nil {
+		fs.Errorf(s.f, "Failed to serve metrics: %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package http
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ncw/rclone/fs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessLog(t *testing.T) {
+	logFilePath = t.TempDir() + "/access.log"
+	logFormat = "json"
+	defer func() {
+		logFilePath = ""
+		logFormat = "combined"
+	}()
+
+	fs.LoadConfig()
+	f, err := fs.NewFs("testdata/files")
+	require.NoError(t, err)
+	url := startServerAt(t, f, "localhost:51787")
+
+	resp, err := http.Get(url + "two.txt")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	time.Sleep(10 * time.Millisecond) // let the handler finish writing the log line
+	body, err := ioutil.ReadFile(logFilePath)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), `"path":"/two.txt"`)
+	assert.Contains(t, string(body), `"status":200`)
+}
+
+// waitForAddr blocks until something is listening on addr, or fails t
+func waitForAddr(t *testing.T, addr string) {
+	pause := time.Millisecond
+	for i := 0; i < 10; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			_ = conn.Close()
+			return
+		}
+		time.Sleep(pause)
+		pause *= 2
+	}
+	t.Fatalf("couldn't connect to %s", addr)
+}
+
+// scrapeCounter fetches /metrics from metricsAddr and returns the value
+// of the first line starting with name (eg "rclone_http_requests_total")
+// and containing labels (eg `status_class="2xx"`), or 0 if not found
+func scrapeCounter(t *testing.T, metricsAddr, name, labels string) float64 {
+	resp, err := http.Get("http://" + metricsAddr + "/metrics")
+	require.NoError(t, err)
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, name) || !strings.Contains(line, labels) {
+			continue
+		}
+		fields := strings.Fields(line)
+		v, err := strconv.ParseFloat(fields[len(fields)-1], 64)
+		require.NoError(t, err)
+		return v
+	}
+	return 0
+}
+
+func TestMetrics(t *testing.T) {
+	const metricsAddress = "localhost:51785"
+	metricsAddr = metricsAddress
+	defer func() { metricsAddr = "" }()
+
+	fs.LoadConfig()
+	f, err := fs.NewFs("testdata/files")
+	require.NoError(t, err)
+	url := startServerAt(t, f, "localhost:51786")
+	waitForAddr(t, metricsAddress)
+
+	before := scrapeCounter(t, metricsAddress, "rclone_http_requests_total", `status_class="2xx"`)
+
+	resp, err := http.Get(url + "two.txt")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	after := scrapeCounter(t, metricsAddress, "rclone_http_requests_total", `status_class="2xx"`)
+	assert.Equal(t, before+1, after)
+
+	opsBefore := scrapeCounter(t, metricsAddress, "rclone_fs_operations_total", `operation="Open"`)
+	resp, err = http.Get(url + "two.txt")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	opsAfter := scrapeCounter(t, metricsAddress, "rclone_fs_operations_total", `operation="Open"`)
+	assert.Equal(t, opsBefore+1, opsAfter)
+}
@@ -0,0 +1,165 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/ncw/rclone/fs"
+)
+
+// Globals
+var (
+	certFile     = ""
+	keyFile      = ""
+	clientCAFile = ""
+	minTLSVer    = "tls1.0"
+)
+
+func init() {
+	Command.Flags().StringVarP(&certFile, "cert", "", certFile, "TLS PEM key (concatenation of certificate and CA certificate).")
+	Command.Flags().StringVarP(&keyFile, "key", "", keyFile, "TLS PEM Private key.")
+	Command.Flags().StringVarP(&clientCAFile, "client-ca", "", clientCAFile, "Client certificate authority to verify clients with (requires --cert and --key).")
+	Command.Flags().StringVarP(&minTLSVer, "min-tls-version", "", minTLSVer, "Minimum TLS version that is acceptable. Valid values are \"tls1.0\", \"tls1.1\", \"tls1.2\" and \"tls1.3\".")
+}
+
+// minTLSVersion maps the --min-tls-version flag to the crypto/tls constant
+func minTLSVersion(s string) (uint16, error) {
+	switch s {
+	case "tls1.0":
+		return tls.VersionTLS10, nil
+	case "tls1.1":
+		return tls.VersionTLS11, nil
+	case "tls1.2":
+		return tls.VersionTLS12, nil
+	case "tls1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("invalid value %q for --min-tls-version", s)
+}
+
+// certReloader stats --cert/--key on every handshake and reloads them
+// when either file's mtime changes, so certificates rotated on disk (eg by
+// ACME/cert-manager) are picked up without restarting the server
+type certReloader struct {
+	certFile, keyFile string
+
+	mu          sync.Mutex
+	cert        *tls.Certificate
+	certModTime int64
+	keyModTime  int64
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.maybeReload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// maybeReload reloads the certificate if either file's mtime has
+// changed since the last load
+func (r *certReloader) maybeReload() error {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return err
+	}
+	certModTime := certInfo.ModTime().UnixNano()
+	keyModTime := keyInfo.ModTime().UnixNano()
+
+	r.mu.Lock()
+	unchanged := r.cert != nil && certModTime == r.certModTime && keyModTime == r.keyModTime
+	r.mu.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.certModTime = certModTime
+	r.keyModTime = keyModTime
+	r.mu.Unlock()
+	fs.Logf(nil, "Loaded TLS certificate from %q/%q", r.certFile, r.keyFile)
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if err := r.maybeReload(); err != nil {
+		fs.Errorf(nil, "Failed to reload TLS certificate, using previous one: %v", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cert == nil {
+		return nil, fmt.Errorf("no TLS certificate loaded")
+	}
+	return r.cert, nil
+}
+
+// tlsConfig builds a *tls.Config from the --cert/--key/--client-ca/
+// --min-tls-version flags, or returns nil if --cert/--key weren't set
+func tlsConfig() (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("--cert and --key must be supplied together")
+	}
+	minVersion, err := minTLSVersion(minTLSVer)
+	if err != nil {
+		return nil, err
+	}
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     minVersion,
+	}
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read --client-ca file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("failed to parse --client-ca file %q", clientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// listen starts listening on bindAddress, wrapping the listener in TLS
+// if a certificate was configured
+func listen(bindAddress string) (net.Listener, error) {
+	l, err := net.Listen("tcp", bindAddress)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := tlsConfig()
+	if err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+	if cfg == nil {
+		return l, nil
+	}
+	return tls.NewListener(l, cfg), nil
+}
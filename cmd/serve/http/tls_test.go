@@ -0,0 +1,150 @@
+package http
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ncw/rclone/fs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	tlsTestDir  string
+	tlsCertPath string
+	tlsKeyPath  string
+)
+
+// TestMain generates a throwaway self-signed certificate once for the
+// whole package, used by TestTLS below
+func TestMain(m *testing.M) {
+	flag.Parse()
+	dir, err := ioutil.TempDir("", "rclone-serve-http-tls")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	tlsTestDir = dir
+	tlsCertPath = filepath.Join(dir, "cert.pem")
+	tlsKeyPath = filepath.Join(dir, "key.pem")
+	if err := writeSelfSignedCert(tlsCertPath, tlsKeyPath, 1); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	_ = os.RemoveAll(tlsTestDir)
+	os.Exit(code)
+}
+
+// writeSelfSignedCert writes a fresh self-signed "localhost" certificate
+// and private key to certPath/keyPath, tagged with serial so tests can
+// tell two generations of the certificate apart
+func writeSelfSignedCert(certPath, keyPath string, serial int64) error {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	certOut, err := os.Create(certPath)
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+		return err
+	}
+	if err := certOut.Close(); err != nil {
+		return err
+	}
+	keyOut, err := os.Create(keyPath)
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(keyOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}); err != nil {
+		return err
+	}
+	return keyOut.Close()
+}
+
+// peerCertSerial dials bindAddress over TLS and returns the serial
+// number of the certificate the server presented
+func peerCertSerial(t *testing.T, bindAddress string) *big.Int {
+	conn, err := tls.Dial("tcp", bindAddress, &tls.Config{InsecureSkipVerify: true})
+	require.NoError(t, err)
+	defer func() {
+		_ = conn.Close()
+	}()
+	certs := conn.ConnectionState().PeerCertificates
+	require.NotEmpty(t, certs)
+	return certs[0].SerialNumber
+}
+
+func TestTLS(t *testing.T) {
+	defer resetAuthFlags()
+	certFile = tlsCertPath
+	keyFile = tlsKeyPath
+	defer func() {
+		certFile = ""
+		keyFile = ""
+	}()
+
+	fs.LoadConfig()
+	f, err := fs.NewFs("testdata/files")
+	require.NoError(t, err)
+
+	const bindAddress = "localhost:51781"
+	s := newServer(f, bindAddress)
+	go s.serve()
+
+	pause := time.Millisecond
+	for i := 0; i < 10; i++ {
+		conn, err := net.Dial("tcp", bindAddress)
+		if err == nil {
+			_ = conn.Close()
+			break
+		}
+		time.Sleep(pause)
+		pause *= 2
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	resp, err := client.Get("https://" + bindAddress + "/two.txt")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	before := peerCertSerial(t, bindAddress)
+
+	// rotate the certificate on disk without restarting the server
+	require.NoError(t, writeSelfSignedCert(tlsCertPath, tlsKeyPath, 2))
+
+	after := peerCertSerial(t, bindAddress)
+	assert.Zero(t, before.Cmp(big.NewInt(1)), "first handshake should see serial 1")
+	assert.Zero(t, after.Cmp(big.NewInt(2)), "server should pick up the new certificate on the next handshake")
+}
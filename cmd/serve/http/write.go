@@ -0,0 +1,216 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ncw/rclone/fs"
+)
+
+// Globals
+var readWrite = false
+
+func init() {
+	Command.Flags().BoolVarP(&readWrite, "read-write", "", readWrite, "Allow PUT/DELETE/MKCOL/MOVE to modify the remote (default is read only).")
+}
+
+// handleWrite dispatches a write request (PUT/DELETE/MKCOL/MOVE) to the
+// appropriate handler. Only reachable when --read-write is set.
+func (s *server) handleWrite(w http.ResponseWriter, r *http.Request) {
+	remote := strings.Trim(r.URL.Path, "/")
+	switch r.Method {
+	case "PUT":
+		s.handlePut(w, r, remote)
+	case "DELETE":
+		s.handleDelete(w, r, remote)
+	case "MKCOL":
+		s.handleMkcol(w, r, remote)
+	case "MOVE":
+		s.handleMove(w, r, remote)
+	}
+}
+
+// handlePut uploads the request body as remote, creating or replacing
+// the object as appropriate
+func (s *server) handlePut(w http.ResponseWriter, r *http.Request, remote string) {
+	if !fs.Config.Filter.Include(remote, r.ContentLength, time.Now()) {
+		s.error(w, "Forbidden", fmt.Errorf("excluded by filters"), http.StatusForbidden)
+		return
+	}
+	if r.ContentLength < 0 {
+		s.error(w, "Length Required", fmt.Errorf("chunked uploads are not supported"), http.StatusLengthRequired)
+		return
+	}
+	info := fs.NewStaticObjectInfo(remote, time.Now(), r.ContentLength, true, nil, s.f)
+	start := time.Now()
+	o, err := s.f.Put(r.Body, info)
+	httpMetrics.addOperation("Put", time.Since(start))
+	if err != nil {
+		s.error(w, "Failed to upload file", err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", etag(o))
+	w.Header().Set("Location", "/"+remote)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handleDelete removes remote, which may be an object (no trailing
+// slash) or a directory (trailing slash)
+func (s *server) handleDelete(w http.ResponseWriter, r *http.Request, remote string) {
+	if strings.HasSuffix(r.URL.Path, "/") {
+		if !fs.Config.Filter.IncludeDirectory(remote) {
+			s.error(w, "Forbidden", fmt.Errorf("excluded by filters"), http.StatusForbidden)
+			return
+		}
+		if err := s.f.Rmdir(remote); err != nil {
+			s.error(w, "Failed to remove directory", err, http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	o, err := s.f.NewObject(remote)
+	if err != nil {
+		s.error(w, "File not found", err, http.StatusNotFound)
+		return
+	}
+	if !fs.Config.Filter.Include(remote, o.Size(), o.ModTime()) {
+		s.error(w, "Forbidden", fmt.Errorf("excluded by filters"), http.StatusForbidden)
+		return
+	}
+	if err := o.Remove(); err != nil {
+		s.error(w, "Failed to remove file", err, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleMkcol creates remote as a new, empty directory
+func (s *server) handleMkcol(w http.ResponseWriter, r *http.Request, remote string) {
+	remote = strings.TrimSuffix(remote, "/")
+	if !fs.Config.Filter.IncludeDirectory(remote) {
+		s.error(w, "Forbidden", fmt.Errorf("excluded by filters"), http.StatusForbidden)
+		return
+	}
+	if err := s.f.Mkdir(remote); err != nil {
+		s.error(w, "Failed to create directory", err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", "/"+remote+"/")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handleMove implements the WebDAV MOVE verb: it moves remote to the
+// path given in the Destination header, using the backend's native
+// Move/DirMove where available and falling back to copy+delete
+// otherwise
+func (s *server) handleMove(w http.ResponseWriter, r *http.Request, remote string) {
+	destHeader := r.Header.Get("Destination")
+	if destHeader == "" {
+		s.error(w, "Bad Request", fmt.Errorf("missing Destination header"), http.StatusBadRequest)
+		return
+	}
+	dest, err := url.Parse(destHeader)
+	if err != nil {
+		s.error(w, "Bad Request", err, http.StatusBadRequest)
+		return
+	}
+	dstRemote := strings.Trim(dest.Path, "/")
+
+	if strings.HasSuffix(r.URL.Path, "/") {
+		srcRemote := strings.TrimSuffix(remote, "/")
+		if !fs.Config.Filter.IncludeDirectory(srcRemote) || !fs.Config.Filter.IncludeDirectory(dstRemote) {
+			s.error(w, "Forbidden", fmt.Errorf("excluded by filters"), http.StatusForbidden)
+			return
+		}
+		if do := s.f.Features().DirMove; do != nil {
+			err = do(s.f, srcRemote, dstRemote)
+		} else {
+			err = s.copyDirThenDelete(srcRemote, dstRemote)
+		}
+		if err != nil {
+			s.error(w, "Failed to move directory", err, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Location", "/"+dstRemote+"/")
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	o, err := s.f.NewObject(remote)
+	if err != nil {
+		s.error(w, "File not found", err, http.StatusNotFound)
+		return
+	}
+	if !fs.Config.Filter.Include(remote, o.Size(), o.ModTime()) || !fs.Config.Filter.Include(dstRemote, o.Size(), o.ModTime()) {
+		s.error(w, "Forbidden", fmt.Errorf("excluded by filters"), http.StatusForbidden)
+		return
+	}
+	if do := s.f.Features().Move; do != nil {
+		_, err = do(o, dstRemote)
+	} else {
+		err = s.copyThenDelete(o, dstRemote)
+	}
+	if err != nil {
+		s.error(w, "Failed to move file", err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", "/"+dstRemote)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// copyThenDelete is the fallback for MOVE of a single object when the
+// backend doesn't implement fs.Features().Move
+func (s *server) copyThenDelete(o fs.Object, dstRemote string) error {
+	in, err := o.Open()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+	info := fs.NewStaticObjectInfo(dstRemote, o.ModTime(), o.Size(), true, nil, s.f)
+	if _, err := s.f.Put(in, info); err != nil {
+		return err
+	}
+	return o.Remove()
+}
+
+// copyDirThenDelete is the fallback for MOVE of a directory when the
+// backend doesn't implement fs.Features().DirMove
+func (s *server) copyDirThenDelete(srcRemote, dstRemote string) error {
+	entries, err := s.f.List(srcRemote)
+	if err != nil {
+		return err
+	}
+	if err := s.f.Mkdir(dstRemote); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		rel := strings.TrimPrefix(strings.TrimPrefix(entry.Remote(), srcRemote), "/")
+		switch x := entry.(type) {
+		case fs.Object:
+			if err := s.copyThenDelete(x, path.Join(dstRemote, rel)); err != nil {
+				return err
+			}
+		case fs.Dir:
+			if err := s.copyDirThenDelete(x.Remote(), path.Join(dstRemote, rel)); err != nil {
+				return err
+			}
+		}
+	}
+	return s.f.Rmdir(srcRemote)
+}
+
+// etag builds an ETag for o, preferring its MD5 if the backend
+// supports one
+func etag(o fs.Object) string {
+	if h, err := o.Hash(fs.HashMD5); err == nil && h != "" {
+		return `"` + h + `"`
+	}
+	return fmt.Sprintf(`"%d-%d"`, o.Size(), o.ModTime().UnixNano())
+}
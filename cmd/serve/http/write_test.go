@@ -0,0 +1,108 @@
+package http
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ncw/rclone/fs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startWriteServer starts a --read-write server backed by a scratch
+// local Fs rooted at t.TempDir(), returning its base URL
+func startWriteServer(t *testing.T, bindAddress string) (string, fs.Fs) {
+	readWrite = true
+	t.Cleanup(func() { readWrite = false })
+
+	fs.LoadConfig()
+	f, err := fs.NewFs(t.TempDir())
+	require.NoError(t, err)
+
+	u := startServerAt(t, f, bindAddress)
+	return u, f
+}
+
+func TestPUT(t *testing.T) {
+	u, f := startWriteServer(t, "localhost:51782")
+
+	req, err := http.NewRequest("PUT", u+"new.txt", strings.NewReader("hello"))
+	require.NoError(t, err)
+	req.ContentLength = 5
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "/new.txt", resp.Header.Get("Location"))
+	assert.NotEmpty(t, resp.Header.Get("ETag"))
+
+	o, err := f.NewObject("new.txt")
+	require.NoError(t, err)
+	in, err := o.Open()
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(in)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+
+	// without --read-write a PUT must be rejected
+	readWrite = false
+	req, err = http.NewRequest("PUT", u+"other.txt", strings.NewReader("nope"))
+	require.NoError(t, err)
+	req.ContentLength = 4
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	readWrite = true
+}
+
+func TestDELETE(t *testing.T) {
+	u, f := startWriteServer(t, "localhost:51783")
+
+	_, err := f.Put(strings.NewReader("bye"), fs.NewStaticObjectInfo("gone.txt", time.Now(), 3, true, nil, f))
+	require.NoError(t, err)
+
+	req, err := http.NewRequest("DELETE", u+"gone.txt", nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	_, err = f.NewObject("gone.txt")
+	assert.Error(t, err)
+
+	req, err = http.NewRequest("DELETE", u+"gone.txt", nil)
+	require.NoError(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// a path excluded by --exclude/--filter must not be deletable even
+	// though it exists. The rule is added here rather than relying on
+	// TestInit, since startWriteServer calls fs.LoadConfig again
+	require.NoError(t, fs.Config.Filter.AddRule("- hidden.txt"))
+	_, err = f.Put(strings.NewReader("shh"), fs.NewStaticObjectInfo("hidden.txt", time.Now(), 3, true, nil, f))
+	require.NoError(t, err)
+	req, err = http.NewRequest("DELETE", u+"hidden.txt", nil)
+	require.NoError(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	_, err = f.NewObject("hidden.txt")
+	assert.NoError(t, err, "excluded file must survive the DELETE")
+}
+
+func TestMKCOL(t *testing.T) {
+	u, f := startWriteServer(t, "localhost:51784")
+
+	req, err := http.NewRequest("MKCOL", u+"newdir/", nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "/newdir/", resp.Header.Get("Location"))
+
+	_, err = f.List("newdir")
+	assert.NoError(t, err)
+}